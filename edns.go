@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ecsSubnet   = flag.String("ecs", "", "Send an EDNS Client Subnet option for this network, e.g. 1.2.3.0/24")
+	dnssec      = flag.Bool("dnssec", false, "Set the DNSSEC OK (DO) bit and report whether the resolver validated (AD bit)")
+	nsid        = flag.Bool("nsid", false, "Request NSID and report the resolver's returned server identity")
+	ednsPayload = flag.Uint("payload", 4096, "Advertised EDNS0 UDP payload size")
+)
+
+// queryProbe captures the EDNS0-derived signals a single query asked the
+// resolver for, alongside the plain RTT/answer-validity check in
+// testresolver: did it validate DNSSEC, did it honor our ECS subnet, and
+// did it return an NSID identifying the answering instance.
+type queryProbe struct {
+	dnssecOK   bool
+	ecsHonored bool
+	nsid       string
+}
+
+// addEDNS0 attaches an OPT RR carrying whichever of ECS/DNSSEC-DO/NSID/
+// payload-size the user asked for via flags, so testresolver can probe
+// resolver capabilities alongside latency.
+func addEDNS0(m *dns.Msg) {
+	if *ecsSubnet == "" && !*dnssec && !*nsid && *ednsPayload == 4096 {
+		return
+	}
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	o.SetUDPSize(uint16(*ednsPayload))
+	if *dnssec {
+		o.SetDo()
+	}
+	if *nsid {
+		o.Option = append(o.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	}
+	if *ecsSubnet != "" {
+		if opt := buildECS(*ecsSubnet); opt != nil {
+			o.Option = append(o.Option, opt)
+		}
+	}
+	m.Extra = append(m.Extra, o)
+}
+
+func buildECS(prefix string) *dns.EDNS0_SUBNET {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil
+	}
+	ones, _ := ipnet.Mask.Size()
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+		Address:       ip,
+	}
+	if ip.To4() != nil {
+		e.Family = 1
+	} else {
+		e.Family = 2
+	}
+	return e
+}
+
+// probeResponse inspects a response for the EDNS0 signals requested via
+// flags.
+func probeResponse(in *dns.Msg) queryProbe {
+	p := queryProbe{dnssecOK: *dnssec && in.AuthenticatedData}
+	if opt := in.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			switch v := o.(type) {
+			case *dns.EDNS0_NSID:
+				p.nsid = v.Nsid
+			case *dns.EDNS0_SUBNET:
+				if *ecsSubnet != "" {
+					p.ecsHonored = true
+				}
+			}
+		}
+	}
+	return p
+}
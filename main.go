@@ -10,10 +10,10 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
-	"github.com/montanaflynn/stats"
 	"github.com/olekukonko/tablewriter"
 	"github.com/vadv/dnsperfbench/pkg/httpbench"
 	"golang.org/x/sync/semaphore"
@@ -33,7 +33,7 @@ func (i *arrayFlags) Set(value string) error {
 var resolvers arrayFlags
 
 var (
-	raw              = flag.Bool("r", false, "Output raw mode")
+	raw              = flag.Bool("r", false, "Output raw mode (deprecated, use -format=raw)")
 	version          = flag.Bool("version", false, "Print version and exit")
 	httptest         = flag.String("httptest", "", "Specify a URL to test including protocol (http or https)")
 	defaultResolvers = []string{}
@@ -54,27 +54,8 @@ var (
 		"[2620:0:ccc::2]":        "OpenDNS", //https://www.opendns.com/about/innovations/ipv6/
 		"[2a0d:2a00:1::]":        "Clean Browsing",
 	}
-	//All answers must match these
-	expectedanswers = map[string]struct{}{
-		"138.197.54.54": struct{}{},
-		"138.197.53.4":  struct{}{},
-	}
 	//Duration to signal fail
-	failDuration = time.Second * 10
-	hostnamesHIT = []string{"fixed.turbobytes.net.", "fixed2.turbobytes.net."}
-	auths        = map[string]string{
-		"NS1":         "tbrum3.com.",
-		"Google":      "tbrum4.com.",
-		"AWS Route53": "tbrum5.com.",
-		"DNSimple":    "tbrum14.com.",
-		"GoDaddy":     "tbrum2.com.",
-		"Akamai":      "tbrum9.com.",
-		"Dyn":         "tbrum10.com.",
-		"CloudFlare":  "tbrum8.com.",
-		"EasyDNS":     "tbrum16.com.",
-		"Ultradns":    "tbrum22.com.",
-		"Azure":       "tbrum25.com.",
-	}
+	failDuration    = time.Second * 10
 	authSl          []string
 	versionString   = "dirty"
 	goVersionString = "unknown"
@@ -82,8 +63,11 @@ var (
 	queryLimit      *semaphore.Weighted
 )
 
-const (
-	testrep = 15 //Number of times to repeat each test
+var (
+	reps                   = flag.Int("reps", 15, "Number of times to repeat each test")
+	warmup                 = flag.Int("warmup", 5, "Number of cache-priming queries to send before timing the ResolverHit test")
+	concurrencyPerResolver = flag.Int("concurrency-per-resolver", 1, "Number of concurrent queries to run per resolver during a single test (default 1, i.e. sequential)")
+	scoreMode              = flag.String("score", "legacy", "Scoring function used to rank resolvers: legacy, p95, mean-plus-fails")
 )
 
 func appendIfMissing(src []string, new string) []string {
@@ -100,10 +84,23 @@ func init() {
 		defaultResolvers = append(defaultResolvers, k)
 	}
 	var tmp arrayFlags
-	flag.Var(&tmp, "resolver", "Additional resolvers to test. default="+strings.Join(defaultResolvers, ", "))
+	flag.Var(&tmp, "resolver", "Additional resolvers to test, as a bare IP (Do53) or a URI (udp://, tcp://, tls://, https://, h3://, quic://, sdns://). default="+strings.Join(defaultResolvers, ", "))
 	maxWorkers := flag.Int("workers", len(defaultResolvers), "Number of tests to run at once")
 	maxQueries := flag.Int("queries", 5, "Limit the number of DNS queries in-flight at a time")
 	flag.Parse()
+	if *raw {
+		//Deprecated -r only wins over the table default, so it doesn't
+		//clobber an explicit -format.
+		formatSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "format" {
+				formatSet = true
+			}
+		})
+		if !formatSet {
+			*format = "raw"
+		}
+	}
 	workerLimit = semaphore.NewWeighted(int64(*maxWorkers))
 	queryLimit = semaphore.NewWeighted(int64(*maxQueries))
 	resolvers = defaultResolvers
@@ -111,11 +108,7 @@ func init() {
 		resolvers = appendIfMissing(resolvers, res)
 	}
 	rand.Seed(time.Now().Unix())
-	authSl = make([]string, 0)
-	for auth := range auths {
-		authSl = append(authSl, auth)
-	}
-	sort.Strings(authSl)
+	loadTargets()
 	if *version {
 		fmt.Println(versionString)
 		fmt.Println(goVersionString)
@@ -133,77 +126,141 @@ func randStringRunes(n int) string {
 	return string(b)
 }
 
-func testresolver(hostname, resolver string) (*time.Duration, error) {
+// answerAddr extracts the address rdata from an A or AAAA record, so
+// callers can validate it against an expected-answer allowlist regardless
+// of which of the two the manifest asked for.
+func answerAddr(rr dns.RR) (string, bool) {
+	switch rec := rr.(type) {
+	case *dns.A:
+		return rec.A.String(), true
+	case *dns.AAAA:
+		return rec.AAAA.String(), true
+	default:
+		return "", false
+	}
+}
+
+func testresolver(hostname, resolver string, qtype uint16, expected map[string]struct{}) (*time.Duration, queryProbe, error) {
 	//Add to ratelimit, block until a slot is available
 	if err := queryLimit.Acquire(context.TODO(), 1); err != nil {
 		log.Fatal("Failed ta acquire semaphore", err)
-		return nil, err
+		return nil, queryProbe{}, err
 	}
 	//Remove from rate limit when done
 	defer queryLimit.Release(1)
 	m := new(dns.Msg)
 	m.Id = dns.Id()
 	m.RecursionDesired = true
-	m.SetQuestion(dns.Fqdn(hostname), dns.TypeA)
-	c := new(dns.Client)
+	m.SetQuestion(dns.Fqdn(hostname), qtype)
+	addEDNS0(m)
+	t, err := getTransport(resolver)
+	if err != nil {
+		return &failDuration, queryProbe{}, err
+	}
 	//Life is too short to wait for DNS...
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	in, rtt, err := c.ExchangeContext(ctx, m, resolver+":53")
+	in, rtt, err := t.exchange(ctx, m)
 	if err != nil {
-		return &failDuration, err
+		return &failDuration, queryProbe{}, err
 	}
 	//Validate response
 	//Expect only one answer
 	if len(in.Answer) != 1 {
-		return &failDuration, fmt.Errorf("Number of answers is not 1")
+		return &failDuration, queryProbe{}, fmt.Errorf("Number of answers is not 1")
 	}
-	arec, ok := in.Answer[0].(*dns.A)
-	if !ok {
-		return &failDuration, fmt.Errorf("Answer is not type A")
+	if in.Answer[0].Header().Rrtype != qtype {
+		return &failDuration, queryProbe{}, fmt.Errorf("Answer is not type %s", dns.TypeToString[qtype])
 	}
-	_, ok = expectedanswers[arec.A.String()]
-	if !ok {
-		return &failDuration, fmt.Errorf("Got strange answer. Evil hijacking resolver?")
+	if len(expected) > 0 {
+		addr, ok := answerAddr(in.Answer[0])
+		if !ok {
+			return &failDuration, queryProbe{}, fmt.Errorf("Can't validate expected answers against a %s record", dns.TypeToString[qtype])
+		}
+		if _, ok := expected[addr]; !ok {
+			return &failDuration, queryProbe{}, fmt.Errorf("Got strange answer. Evil hijacking resolver?")
+		}
 	}
 	//rtt = rtt.Truncate(time.Millisecond / 4)
-	return &rtt, nil
+	return &rtt, probeResponse(in), nil
+}
+
+type repResult struct {
+	rtt   time.Duration
+	probe queryProbe
+	err   error
 }
 
-func runtests(host, res string, rndSuffix bool) resolverResults {
-	//Actual test...
-	vals := make([]time.Duration, 0)
+func runtests(host, res string, rndSuffix bool, qtype uint16, expected map[string]struct{}) resolverResults {
+	//Actual test... up to concurrency-per-resolver queries in flight at once.
+	sem := semaphore.NewWeighted(int64(*concurrencyPerResolver))
+	repchan := make(chan repResult, *reps)
+	var wg sync.WaitGroup
+	for i := 0; i < *reps; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sem.Acquire(context.Background(), 1); err != nil {
+				repchan <- repResult{err: err}
+				return
+			}
+			defer sem.Release(1)
+			hostname := host
+			if rndSuffix {
+				hostname = randStringRunes(15) + "." + host
+			}
+			rtt, probe, err := testresolver(hostname, res, qtype, expected)
+			repchan <- repResult{rtt: *rtt, probe: probe, err: err}
+		}()
+	}
+	wg.Wait()
+	close(repchan)
+
+	vals := make([]time.Duration, 0, *reps)
 	fails := 0
-	for i := 0; i < testrep; i++ {
-		hostname := host
-		if rndSuffix {
-			hostname = randStringRunes(15) + "." + host
-		}
-		rtt, err := testresolver(hostname, res)
-		vals = append(vals, *rtt)
-		if err != nil {
+	dnssecOK := 0
+	ecsHonored := 0
+	nsidSeen := ""
+	for rep := range repchan {
+		vals = append(vals, rep.rtt)
+		if rep.err != nil {
 			fails++
+			continue
+		}
+		if rep.probe.dnssecOK {
+			dnssecOK++
+		}
+		if rep.probe.ecsHonored {
+			ecsHonored++
+		}
+		if rep.probe.nsid != "" {
+			nsidSeen = rep.probe.nsid
 		}
 	}
-	//Print summary
-	//fmt.Printf("Failures: %v of 5\n", fails)
-	//fmt.Printf("Timings: %v\n", vals)
-	validVals := make([]float64, len(vals))
-	for i, val := range vals {
-		validVals[i] = float64(val)
+	summary := summarizeDurations(vals)
+	return resolverResults{
+		mean:       summary.mean,
+		median:     summary.median,
+		p90:        summary.p90,
+		p95:        summary.p95,
+		p99:        summary.p99,
+		stddev:     summary.stddev,
+		min:        summary.min,
+		max:        summary.max,
+		failratio:  float64(fails) / float64(*reps),
+		dnssecOK:   *dnssec && dnssecOK > 0,
+		ecsHonored: *ecsSubnet != "" && ecsHonored > 0,
+		nsid:       nsidSeen,
 	}
-	median, _ := stats.Median(validVals)
-	mean, _ := stats.Mean(validVals)
-	return resolverResults{mean: time.Duration(mean), median: time.Duration(median), failratio: float64(fails) / testrep}
 }
 
-//SummaryResolver stores score for individual resolver
+// SummaryResolver stores score for individual resolver
 type SummaryResolver struct {
 	Res   string
 	Score float64
 }
 
-//Summary enables sorting slice of SummaryResolver
+// Summary enables sorting slice of SummaryResolver
 type Summary []SummaryResolver
 
 func (a Summary) Len() int           { return len(a) }
@@ -211,9 +268,14 @@ func (a Summary) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a Summary) Less(i, j int) bool { return a[i].Score < a[j].Score }
 
 type resolverResults struct {
-	mean      time.Duration
-	median    time.Duration
-	failratio float64
+	mean             time.Duration
+	median           time.Duration
+	p90, p95, p99    time.Duration
+	stddev, min, max time.Duration
+	failratio        float64
+	dnssecOK         bool
+	ecsHonored       bool
+	nsid             string
 }
 
 type recursiveResults map[string]resolverResults
@@ -223,29 +285,51 @@ func getms(dur time.Duration) float64 {
 }
 
 func (res recursiveResults) Print(resolver, name string) {
-	if *raw {
+	switch *format {
+	case "ndjson":
+		res.printNDJSON(resolver)
+		return
+	case "json", "prom":
+		//Accumulated in main and rendered once every resolver has finished.
+		return
+	}
+	if *format == "raw" {
 		result := res["ResolverHit"]
-		fmt.Printf("Raw\t%s\tResolverHit\t%.2f\t%.2f\t%.2f\n", resolver, getms(result.mean), getms(result.median), result.failratio*100)
+		fmt.Printf("Raw\t%s\tResolverHit\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%v\t%v\t%s\n", resolver, getms(result.mean), getms(result.median), getms(result.p95), getms(result.stddev), result.failratio*100, getms(result.min), getms(result.max), result.dnssecOK, result.ecsHonored, result.nsid)
 		for _, auth := range authSl {
 			result := res[auth]
-			fmt.Printf("Raw\t%s\t%s\t%.2f\t%.2f\t%.2f\n", resolver, auth, getms(result.mean), getms(result.median), result.failratio*100)
+			fmt.Printf("Raw\t%s\t%s\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%v\t%v\t%s\n", resolver, auth, getms(result.mean), getms(result.median), getms(result.p95), getms(result.stddev), result.failratio*100, getms(result.min), getms(result.max), result.dnssecOK, result.ecsHonored, result.nsid)
 		}
 	} else {
 		fmt.Printf("========== %s (%s) ===========\n", resolver, name)
 		table := tablewriter.NewWriter(os.Stdout)
 		table.SetAutoWrapText(false)
-		table.SetHeader([]string{"Auth", "Mean", "Median", "Fail"})
+		table.SetHeader([]string{"Auth", "Mean", "Median", "P95", "StdDev", "Min", "Max", "Fail", "DNSSEC", "ECS", "NSID"})
 		result := res["ResolverHit"]
-		table.Append([]string{"ResolverHit", result.mean.Round(time.Millisecond).String(), result.median.Round(time.Millisecond).String(), fmt.Sprintf("%.2f%%", result.failratio*100)})
+		table.Append([]string{"ResolverHit", result.mean.Round(time.Millisecond).String(), result.median.Round(time.Millisecond).String(), result.p95.Round(time.Millisecond).String(), result.stddev.Round(time.Millisecond).String(), result.min.Round(time.Millisecond).String(), result.max.Round(time.Millisecond).String(), fmt.Sprintf("%.2f%%", result.failratio*100), fmt.Sprintf("%v", result.dnssecOK), fmt.Sprintf("%v", result.ecsHonored), result.nsid})
 		for _, auth := range authSl {
 			result := res[auth]
-			table.Append([]string{auth, result.mean.Round(time.Millisecond).String(), result.median.Round(time.Millisecond).String(), fmt.Sprintf("%.2f%%", result.failratio*100)})
+			table.Append([]string{auth, result.mean.Round(time.Millisecond).String(), result.median.Round(time.Millisecond).String(), result.p95.Round(time.Millisecond).String(), result.stddev.Round(time.Millisecond).String(), result.min.Round(time.Millisecond).String(), result.max.Round(time.Millisecond).String(), fmt.Sprintf("%.2f%%", result.failratio*100), fmt.Sprintf("%v", result.dnssecOK), fmt.Sprintf("%v", result.ecsHonored), result.nsid})
 		}
 		table.Render()
 	}
 }
 
+// Score ranks a resolver using whichever function --score selects; lower
+// is better in every case.
 func (res recursiveResults) Score() float64 {
+	switch *scoreMode {
+	case "p95":
+		return res.scoreP95()
+	case "mean-plus-fails":
+		return res.scoreMeanPlusFails()
+	default:
+		return res.scoreLegacy()
+	}
+}
+
+// scoreLegacy is the original hand-tuned weighted mean+median.
+func (res recursiveResults) scoreLegacy() float64 {
 	result := res["ResolverHit"]
 	score := 5 * (float64(result.mean/time.Millisecond) + float64(result.median/time.Millisecond))
 	for _, auth := range authSl {
@@ -255,19 +339,43 @@ func (res recursiveResults) Score() float64 {
 	return score
 }
 
+// scoreP95 ranks resolvers by tail latency, so a single slow outlier
+// dominates the way it would for a real user's page load.
+func (res recursiveResults) scoreP95() float64 {
+	result := res["ResolverHit"]
+	score := 5 * float64(result.p95/time.Millisecond)
+	for _, auth := range authSl {
+		score += float64(res[auth].p95 / time.Millisecond)
+	}
+	return score
+}
+
+// scoreMeanPlusFails ranks resolvers by mean latency, penalized
+// multiplicatively by their failure ratio so flaky resolvers sort worse
+// than their raw latency alone would suggest.
+func (res recursiveResults) scoreMeanPlusFails() float64 {
+	result := res["ResolverHit"]
+	score := 5 * float64(result.mean/time.Millisecond) * (1 + result.failratio*10)
+	for _, auth := range authSl {
+		result := res[auth]
+		score += float64(result.mean/time.Millisecond) * (1 + result.failratio*10)
+	}
+	return score
+}
+
 func testrecursive(res string) recursiveResults {
 	results := make(map[string]resolverResults)
-	hithost := hostnamesHIT[rand.Intn(len(hostnamesHIT))]
+	hit := hostnamesHIT[rand.Intn(len(hostnamesHIT))]
 	//Prime the caches... ignoring results
-	for i := 0; i < 5; i++ {
-		testresolver(hithost, res)
+	for i := 0; i < *warmup; i++ {
+		testresolver(hit.Hostname, res, dns.TypeA, hit.Expected)
 	}
-	results["ResolverHit"] = runtests(hithost, res, false)
+	results["ResolverHit"] = runtests(hit.Hostname, res, false, dns.TypeA, hit.Expected)
 
 	//Perform the auths
 	for _, auth := range authSl {
-		host := auths[auth]
-		results[auth] = runtests(host, res, true)
+		t := authTargets[auth]
+		results[auth] = runtests(t.Hostname, res, t.RndSuffix, t.QType, t.Expected)
 	}
 	return results
 }
@@ -321,8 +429,6 @@ func main() {
 		os.Exit(0)
 	}
 
-	resscore := make(map[string]float64)
-	results := make(map[string]recursiveResults)
 	resultschan := make(chan resultoutput, 1)
 
 	// Respect worker limit.
@@ -342,28 +448,36 @@ func main() {
 			resultschan <- resultoutput{recursive: recursive, result: testrecursive(recursive)}
 		}(res)
 	}
-	//Gather results
+	//Gather and print results as each resolver finishes, instead of
+	//blocking until the whole batch completes.
+	results := make(map[string]recursiveResults, len(resolvers))
+	summary := make(Summary, 0, len(resolvers))
 	for i := range resolvers {
 		result := <-resultschan
 		log.Printf("[%v/%v] Got results for %s\n", i+1, len(resolvers), result.recursive)
-		results[result.recursive] = result.result
-	}
-	for _, res := range resolvers {
-		name := resolverNames[res]
+		name := resolverNames[result.recursive]
 		if name == "" {
 			name = "Unknown"
 		}
-		result := results[res]
-		result.Print(res, name)
-		resscore[res] = result.Score()
-	}
-	//Make slice
-	var summary Summary = make([]SummaryResolver, 0)
-	for k, v := range resscore {
-		summary = append(summary, SummaryResolver{k, v})
+		results[result.recursive] = result.result
+		result.result.Print(result.recursive, name)
+		summary = append(summary, SummaryResolver{result.recursive, result.result.Score()})
 	}
 	sort.Sort(summary)
-	if !*raw {
+
+	switch *format {
+	case "json":
+		printJSONDocument(results)
+		return
+	case "prom":
+		printPromDocument(results)
+		return
+	case "ndjson":
+		printNDJSONSummary(summary)
+		return
+	}
+
+	if *format != "raw" {
 		fmt.Printf("========== Summary ===========\n")
 		fmt.Println("Scores (lower is better)")
 	}
@@ -378,12 +492,12 @@ func main() {
 			name = "Unknown"
 		}
 		table.Append([]string{fmt.Sprintf("%s (%s)", sum.Res, name), fmt.Sprintf("%.0f", sum.Score)})
-		if *raw {
+		if *format == "raw" {
 			fmt.Printf("Score\t%s\t%.0f\n", sum.Res, sum.Score)
 		}
 		//log.Println(sum.Res, sum.Score)
 	}
-	if *raw {
+	if *format == "raw" {
 		fmt.Printf("Recommendation\t%s\n", summary[0].Res)
 	} else {
 		table.Render()
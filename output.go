@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var format = flag.String("format", "table", "Output format: table, raw, json, ndjson, prom (supersedes -r)")
+
+// measurementJSON is the per (resolver, auth) entry in the --format=json
+// document and the per-line shape for --format=ndjson.
+type measurementJSON struct {
+	Resolver  string  `json:"resolver"`
+	Auth      string  `json:"auth"`
+	MeanNS    int64   `json:"mean_ns"`
+	MedianNS  int64   `json:"median_ns"`
+	P90NS     int64   `json:"p90_ns"`
+	P95NS     int64   `json:"p95_ns"`
+	P99NS     int64   `json:"p99_ns"`
+	StdDevNS  int64   `json:"stddev_ns"`
+	MinNS     int64   `json:"min_ns"`
+	MaxNS     int64   `json:"max_ns"`
+	FailRatio float64 `json:"fail_ratio"`
+}
+
+func toMeasurement(resolver, auth string, r resolverResults) measurementJSON {
+	return measurementJSON{
+		Resolver:  resolver,
+		Auth:      auth,
+		MeanNS:    r.mean.Nanoseconds(),
+		MedianNS:  r.median.Nanoseconds(),
+		P90NS:     r.p90.Nanoseconds(),
+		P95NS:     r.p95.Nanoseconds(),
+		P99NS:     r.p99.Nanoseconds(),
+		StdDevNS:  r.stddev.Nanoseconds(),
+		MinNS:     r.min.Nanoseconds(),
+		MaxNS:     r.max.Nanoseconds(),
+		FailRatio: r.failratio,
+	}
+}
+
+// printNDJSON emits one JSON object per (resolver, auth) measurement. It's
+// called as each resolver's results become available, pairing with the
+// streaming gather loop in main.
+func (res recursiveResults) printNDJSON(resolver string) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.Encode(toMeasurement(resolver, "ResolverHit", res["ResolverHit"]))
+	for _, auth := range authSl {
+		enc.Encode(toMeasurement(resolver, auth, res[auth]))
+	}
+}
+
+// printJSONDocument emits a single JSON document containing every
+// resolver's measurements, keyed by resolver. Unlike raw/ndjson/table it
+// can only be rendered once every resolver has finished.
+func printJSONDocument(results map[string]recursiveResults) {
+	doc := make(map[string][]measurementJSON, len(results))
+	for resolver, res := range results {
+		measurements := make([]measurementJSON, 0, len(authSl)+1)
+		measurements = append(measurements, toMeasurement(resolver, "ResolverHit", res["ResolverHit"]))
+		for _, auth := range authSl {
+			measurements = append(measurements, toMeasurement(resolver, auth, res[auth]))
+		}
+		doc[resolver] = measurements
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(doc)
+}
+
+// scoreJSON is the one-line-per-resolver shape emitted by --format=ndjson
+// for the final leaderboard.
+type scoreJSON struct {
+	Resolver string  `json:"resolver"`
+	Score    float64 `json:"score"`
+}
+
+func printNDJSONSummary(summary Summary) {
+	enc := json.NewEncoder(os.Stdout)
+	for _, sum := range summary {
+		enc.Encode(scoreJSON{Resolver: sum.Res, Score: sum.Score})
+	}
+}
+
+// printPromDocument renders every resolver's measurements as Prometheus
+// text-format gauges, suitable for scraping when dnsperfbench is run as a
+// periodic job.
+func printPromDocument(results map[string]recursiveResults) {
+	emit := func(resolver, auth string, r resolverResults) {
+		fmt.Printf("dnsperf_rtt_seconds{resolver=%q, auth=%q, quantile=\"0.5\"} %f\n", resolver, auth, r.median.Seconds())
+		fmt.Printf("dnsperf_rtt_seconds{resolver=%q, auth=%q, quantile=\"0.9\"} %f\n", resolver, auth, r.p90.Seconds())
+		fmt.Printf("dnsperf_rtt_seconds{resolver=%q, auth=%q, quantile=\"0.95\"} %f\n", resolver, auth, r.p95.Seconds())
+		fmt.Printf("dnsperf_rtt_seconds{resolver=%q, auth=%q, quantile=\"0.99\"} %f\n", resolver, auth, r.p99.Seconds())
+	}
+	emitMean := func(resolver, auth string, r resolverResults) {
+		fmt.Printf("dnsperf_rtt_seconds_mean_seconds{resolver=%q, auth=%q} %f\n", resolver, auth, r.mean.Seconds())
+	}
+	fmt.Println("# HELP dnsperf_rtt_seconds DNS round-trip time observed by dnsperfbench")
+	fmt.Println("# TYPE dnsperf_rtt_seconds gauge")
+	for resolver, res := range results {
+		emit(resolver, "ResolverHit", res["ResolverHit"])
+		for _, auth := range authSl {
+			emit(resolver, auth, res[auth])
+		}
+	}
+	fmt.Println("# HELP dnsperf_rtt_seconds_mean_seconds Mean DNS round-trip time observed by dnsperfbench")
+	fmt.Println("# TYPE dnsperf_rtt_seconds_mean_seconds gauge")
+	for resolver, res := range results {
+		emitMean(resolver, "ResolverHit", res["ResolverHit"])
+		for _, auth := range authSl {
+			emitMean(resolver, auth, res[auth])
+		}
+	}
+	fmt.Println("# HELP dnsperf_fail_ratio Fraction of queries that failed or got a hijacked answer")
+	fmt.Println("# TYPE dnsperf_fail_ratio gauge")
+	for resolver, res := range results {
+		fmt.Printf("dnsperf_fail_ratio{resolver=%q, auth=%q} %f\n", resolver, "ResolverHit", res["ResolverHit"].failratio)
+		for _, auth := range authSl {
+			fmt.Printf("dnsperf_fail_ratio{resolver=%q, auth=%q} %f\n", resolver, auth, res[auth].failratio)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+// durationSummary holds the distribution statistics computed over one
+// batch of RTT samples for a single (resolver, target) pair.
+type durationSummary struct {
+	mean, median     time.Duration
+	p90, p95, p99    time.Duration
+	stddev, min, max time.Duration
+}
+
+// summarizeDurations reduces a batch of RTT samples to the statistics
+// resolverResults reports: mean/median plus tail percentiles, jitter
+// (standard deviation) and the extremes, using montanaflynn/stats.
+func summarizeDurations(vals []time.Duration) durationSummary {
+	floats := make([]float64, len(vals))
+	for i, v := range vals {
+		floats[i] = float64(v)
+	}
+	mean, _ := stats.Mean(floats)
+	median, _ := stats.Median(floats)
+	p90, _ := stats.Percentile(floats, 90)
+	p95, _ := stats.Percentile(floats, 95)
+	p99, _ := stats.Percentile(floats, 99)
+	stddev, _ := stats.StandardDeviation(floats)
+	min, _ := stats.Min(floats)
+	max, _ := stats.Max(floats)
+	return durationSummary{
+		mean:   time.Duration(mean),
+		median: time.Duration(median),
+		p90:    time.Duration(p90),
+		p95:    time.Duration(p95),
+		p99:    time.Duration(p99),
+		stddev: time.Duration(stddev),
+		min:    time.Duration(min),
+		max:    time.Duration(max),
+	}
+}
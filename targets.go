@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+var targetsFile = flag.String("targets", "", "Load recursive-hit hostnames and authoritative targets from a YAML or JSON manifest, instead of the built-in turbobytes.net defaults")
+
+// hitTargetSpec is the on-disk shape of one recursive-hit hostname entry
+// in a --targets manifest.
+type hitTargetSpec struct {
+	Hostname string   `json:"hostname" yaml:"hostname"`
+	Expected []string `json:"expected,omitempty" yaml:"expected,omitempty"`
+}
+
+// authTargetSpec is the on-disk shape of one authoritative provider entry
+// in a --targets manifest.
+type authTargetSpec struct {
+	Name      string   `json:"name" yaml:"name"`
+	Hostname  string   `json:"hostname" yaml:"hostname"`
+	Expected  []string `json:"expected,omitempty" yaml:"expected,omitempty"`
+	RndSuffix *bool    `json:"rndSuffix,omitempty" yaml:"rndSuffix,omitempty"`
+	QType     string   `json:"qtype,omitempty" yaml:"qtype,omitempty"`
+}
+
+// targetManifest is the on-disk shape accepted by --targets.
+type targetManifest struct {
+	Hostnames []hitTargetSpec  `json:"hostnames" yaml:"hostnames"`
+	Auths     []authTargetSpec `json:"auths" yaml:"auths"`
+}
+
+// hitTarget is the resolved, ready-to-query form of a hitTargetSpec, mirroring
+// authTarget so the ResolverHit test gets the same hijack-detection an auth
+// target gets. An empty Expected means "don't enforce an answer allowlist".
+type hitTarget struct {
+	Hostname string
+	Expected map[string]struct{}
+}
+
+// authTarget is the resolved, ready-to-query form of an authTargetSpec:
+// defaults applied and the expected answer set keyed for O(1) lookup. An
+// empty Expected means "don't enforce an answer allowlist for this target".
+type authTarget struct {
+	Hostname  string
+	Expected  map[string]struct{}
+	RndSuffix bool
+	QType     uint16
+}
+
+// defaultManifest mirrors the historical hard-coded turbobytes.net
+// infrastructure, used as the fallback when --targets isn't given. The hit
+// hostnames share the same expected-answer set the auths do, matching
+// baseline's single global allowlist checked against every query.
+var defaultManifest = targetManifest{
+	Hostnames: []hitTargetSpec{
+		{Hostname: "fixed.turbobytes.net.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Hostname: "fixed2.turbobytes.net.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+	},
+	Auths: []authTargetSpec{
+		{Name: "NS1", Hostname: "tbrum3.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "Google", Hostname: "tbrum4.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "AWS Route53", Hostname: "tbrum5.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "DNSimple", Hostname: "tbrum14.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "GoDaddy", Hostname: "tbrum2.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "Akamai", Hostname: "tbrum9.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "Dyn", Hostname: "tbrum10.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "CloudFlare", Hostname: "tbrum8.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "EasyDNS", Hostname: "tbrum16.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "Ultradns", Hostname: "tbrum22.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+		{Name: "Azure", Hostname: "tbrum25.com.", Expected: []string{"138.197.54.54", "138.197.53.4"}},
+	},
+}
+
+var (
+	hostnamesHIT []hitTarget
+	authTargets  = map[string]authTarget{}
+)
+
+// loadTargets populates hostnamesHIT, authTargets and authSl either from
+// the manifest named by --targets or, if it's empty, the embedded default.
+// Every auth entry defaults to RndSuffix=true, matching the historical
+// hard-coded behavior of cache-busting each authoritative lookup.
+func loadTargets() {
+	manifest := defaultManifest
+	if *targetsFile != "" {
+		m, err := readManifest(*targetsFile)
+		if err != nil {
+			log.Fatalf("Failed to load --targets %s: %v", *targetsFile, err)
+		}
+		manifest = *m
+	}
+
+	hostnamesHIT = make([]hitTarget, 0, len(manifest.Hostnames))
+	for _, spec := range manifest.Hostnames {
+		expected := make(map[string]struct{}, len(spec.Expected))
+		for _, ip := range spec.Expected {
+			expected[ip] = struct{}{}
+		}
+		hostnamesHIT = append(hostnamesHIT, hitTarget{Hostname: spec.Hostname, Expected: expected})
+	}
+	authTargets = make(map[string]authTarget, len(manifest.Auths))
+	authSl = make([]string, 0, len(manifest.Auths))
+	for _, spec := range manifest.Auths {
+		rndSuffix := true
+		if spec.RndSuffix != nil {
+			rndSuffix = *spec.RndSuffix
+		}
+		expected := make(map[string]struct{}, len(spec.Expected))
+		for _, ip := range spec.Expected {
+			expected[ip] = struct{}{}
+		}
+		qtype := uint16(dns.TypeA)
+		if spec.QType != "" {
+			t, ok := dns.StringToType[strings.ToUpper(spec.QType)]
+			if !ok {
+				log.Fatalf("--targets: auth %q has unknown qtype %q", spec.Name, spec.QType)
+			}
+			qtype = t
+		}
+		authTargets[spec.Name] = authTarget{Hostname: spec.Hostname, Expected: expected, RndSuffix: rndSuffix, QType: qtype}
+		authSl = append(authSl, spec.Name)
+	}
+	sort.Strings(authSl)
+}
+
+func readManifest(path string) (*targetManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := new(targetManifest)
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, m)
+	} else {
+		err = yaml.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest: %v", err)
+	}
+	if len(m.Hostnames) == 0 {
+		return nil, fmt.Errorf("manifest has no recursive-hit hostnames")
+	}
+	return m, nil
+}
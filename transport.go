@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// dnsTransport abstracts the wire protocol used to reach a resolver, so
+// testresolver doesn't need to care whether it's talking Do53, DoT, DoH,
+// DoH3, DoQ or DNSCrypt.
+type dnsTransport interface {
+	exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, time.Duration, error)
+	// label identifies the transport in output, e.g. "udp://1.1.1.1:53".
+	label() string
+}
+
+// transportEntry lazily builds one resolver's transport behind a per-key
+// sync.Once, so the handshake (which may block on the network, e.g.
+// dnscrypt's Dial) never holds transportCacheMu.
+type transportEntry struct {
+	once sync.Once
+	t    dnsTransport
+	err  error
+}
+
+var (
+	transportCacheMu sync.Mutex
+	transportCache   = map[string]*transportEntry{}
+)
+
+// getTransport returns the cached transport for raw, building and caching
+// it on first use. raw may be a bare host (legacy bare-IP resolvers, treated
+// as plain Do53) or a URI such as tls://1.1.1.1:853 or sdns://.... A slow or
+// dead resolver's handshake only blocks callers asking for that same raw,
+// not the rest of the cache.
+func getTransport(raw string) (dnsTransport, error) {
+	transportCacheMu.Lock()
+	e, ok := transportCache[raw]
+	if !ok {
+		e = new(transportEntry)
+		transportCache[raw] = e
+	}
+	transportCacheMu.Unlock()
+
+	e.once.Do(func() {
+		e.t, e.err = newTransport(raw)
+	})
+	return e.t, e.err
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return net.JoinHostPort(u.Hostname(), u.Port())
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+func newTransport(raw string) (dnsTransport, error) {
+	uri := raw
+	if !strings.Contains(uri, "://") {
+		// Legacy bare host/IP resolver entry, e.g. "8.8.8.8" -> plain Do53.
+		uri = "udp://" + uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver %q: %v", raw, err)
+	}
+	switch u.Scheme {
+	case "udp":
+		return &do53Transport{addr: hostPort(u, "53"), client: &dns.Client{Net: "udp", Timeout: time.Second}}, nil
+	case "tcp":
+		return &do53Transport{addr: hostPort(u, "53"), client: &dns.Client{Net: "tcp", Timeout: time.Second}}, nil
+	case "tls":
+		return &do53Transport{
+			addr: hostPort(u, "853"),
+			client: &dns.Client{
+				Net:       "tcp-tls",
+				Timeout:   time.Second,
+				TLSConfig: &tls.Config{ServerName: u.Hostname()},
+			},
+		}, nil
+	case "https":
+		return newDoHTransport(uri, false)
+	case "h3":
+		return newDoHTransport("https://"+u.Host+u.Path, true)
+	case "quic":
+		return &doqTransport{
+			addr:    hostPort(u, "853"),
+			tlsConf: &tls.Config{ServerName: u.Hostname(), NextProtos: []string{"doq"}},
+		}, nil
+	case "sdns":
+		return newDNSCryptTransport(uri)
+	default:
+		return nil, fmt.Errorf("unsupported resolver scheme %q in %q", u.Scheme, raw)
+	}
+}
+
+// do53Transport covers plain Do53 (udp/tcp) and DoT, all of which map
+// cleanly onto miekg/dns.Client's Net modes.
+type do53Transport struct {
+	addr   string
+	client *dns.Client
+}
+
+func (t *do53Transport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return t.client.ExchangeContext(ctx, m, t.addr)
+}
+
+func (t *do53Transport) label() string {
+	if t.client.Net == "tcp-tls" {
+		return "tls://" + t.addr
+	}
+	return t.client.Net + "://" + t.addr
+}
+
+// dohTransport implements RFC 8484 DNS-over-HTTPS (GET/POST semantics via
+// POST with application/dns-message), optionally over HTTP/3 (DoH3).
+type dohTransport struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHTransport(urlStr string, h3 bool) (*dohTransport, error) {
+	client := &http.Client{Timeout: time.Second}
+	if h3 {
+		client.Transport = &http3.RoundTripper{}
+	}
+	return &dohTransport{url: urlStr, client: client}, nil
+}
+
+func (t *dohTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, failDuration, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, failDuration, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	start := time.Now()
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, failDuration, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, failDuration, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, failDuration, fmt.Errorf("DoH request to %s failed with status %s", t.url, resp.Status)
+	}
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, failDuration, err
+	}
+	return in, rtt, nil
+}
+
+func (t *dohTransport) label() string {
+	return t.url
+}
+
+// doqTransport implements RFC 9250 DNS-over-QUIC: one query per stream,
+// each message prefixed with its 2-byte length as on a TCP connection.
+type doqTransport struct {
+	addr    string
+	tlsConf *tls.Config
+}
+
+func (t *doqTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	conn, err := quic.DialAddr(ctx, t.addr, t.tlsConf, nil)
+	if err != nil {
+		return nil, failDuration, err
+	}
+	defer conn.CloseWithError(0, "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, failDuration, err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, failDuration, err
+	}
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	if _, err := stream.Write(buf); err != nil {
+		return nil, failDuration, err
+	}
+	stream.Close()
+
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(stream, lenBuf); err != nil {
+		return nil, failDuration, err
+	}
+	respBuf := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(stream, respBuf); err != nil {
+		return nil, failDuration, err
+	}
+	rtt := time.Since(start)
+
+	in := new(dns.Msg)
+	if err := in.Unpack(respBuf); err != nil {
+		return nil, failDuration, err
+	}
+	return in, rtt, nil
+}
+
+func (t *doqTransport) label() string {
+	return "quic://" + t.addr
+}
+
+// dnscryptTransport talks the DNSCrypt protocol given a "sdns://" stamp.
+type dnscryptTransport struct {
+	stamp  string
+	client *dnscrypt.Client
+	info   *dnscrypt.ResolverInfo
+}
+
+func newDNSCryptTransport(stamp string) (*dnscryptTransport, error) {
+	client := &dnscrypt.Client{Net: "udp", Timeout: time.Second}
+	info, err := client.Dial(stamp)
+	if err != nil {
+		return nil, fmt.Errorf("dnscrypt handshake with %s failed: %v", stamp, err)
+	}
+	return &dnscryptTransport{stamp: stamp, client: client, info: info}, nil
+}
+
+func (t *dnscryptTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	in, err := t.client.Exchange(m, t.info)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	return in, time.Since(start), nil
+}
+
+func (t *dnscryptTransport) label() string {
+	return t.stamp
+}